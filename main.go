@@ -1,24 +1,58 @@
 package main
 
 import (
+	"archive/tar"
 	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/ethersphere/bee/pkg/cac"
 	"github.com/ethersphere/bee/pkg/localstore"
+	"github.com/ethersphere/bee/pkg/log"
 	"github.com/ethersphere/bee/pkg/postage"
+	"github.com/ethersphere/bee/pkg/postage/batchstore"
 	"github.com/ethersphere/bee/pkg/sharky"
 	"github.com/ethersphere/bee/pkg/shed"
 	"github.com/ethersphere/bee/pkg/soc"
+	statestore "github.com/ethersphere/bee/pkg/statestore/leveldb"
 	"github.com/ethersphere/bee/pkg/swarm"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 var path = flag.String("path", "./localstore", "path to localstore directory")
+var repair = flag.Bool("repair", false, "rebuild derived indexes from retrievalDataIndex and fix gc/reserve counters")
+var batchstorePath = flag.String("batchstore", "", "path to the Bee node's statestore directory, enables postage stamp verification")
+var basekey = flag.String("basekey", "", "hex-encoded 32-byte node overlay, enables PO and BinID ordering checks")
+var exportPath = flag.String("export", "", "write every successfully validated chunk to this tar archive while checking")
+var importPath = flag.String("import", "", "replay a tar archive written by -export into a fresh localstore at -path")
+
+// po computes the proximity order byte that pullIndex and postageChunksIndex
+// keys are prefixed with. It returns 0 when baseKey is unset (-basekey not
+// given), matching the tool's previous behaviour of leaving that byte zero.
+func po(baseKey, address []byte) uint8 {
+	if len(baseKey) == 0 {
+		return 0
+	}
+	return swarm.Proximity(baseKey, address)
+}
+
+// repairBatchSize bounds how many items are rewritten before a leveldb.Batch
+// is flushed, so a crash mid-repair leaves the shed DB in a consistent state.
+const repairBatchSize = 10000
+
+// sharkyShardCnt must match the shard count the localstore was opened with.
+const sharkyShardCnt = 32
+
+// retrievalDataHeaderSize is the fixed-size prefix of a retrievalDataIndex
+// value: BinID (8), StoreTimestamp (8), and the marshalled postage stamp.
+var retrievalDataHeaderSize = 16 + postage.StampSize
 
 type dirFS struct {
 	basedir string
@@ -31,6 +65,25 @@ func (d *dirFS) Open(path string) (fs.File, error) {
 func main() {
 	flag.Parse()
 
+	var baseKey []byte
+	if *basekey != "" {
+		var err error
+		baseKey, err = hex.DecodeString(*basekey)
+		if err != nil || len(baseKey) != 32 {
+			fmt.Println("basekey should be a hex-encoded 32-byte overlay address")
+			return
+		}
+	}
+
+	if *importPath != "" {
+		if err := runImport(*path, *importPath); err != nil {
+			fmt.Printf("import failed: %v\n", err)
+			return
+		}
+		fmt.Println("Import complete")
+		return
+	}
+
 	if _, err := os.Stat(*path); os.IsNotExist(err) {
 		fmt.Println("path should be full path to localstore directory")
 		return
@@ -53,7 +106,25 @@ func main() {
 
 	sharkyBase := &dirFS{basedir: sharkyBasePath}
 
-	sharkyStore, err := sharky.New(sharkyBase, 32, swarm.SocMaxChunkSize)
+	// batchStore is only needed to look up batch owners for stamp signature
+	// verification, so it stays nil when -batchstore isn't given.
+	var batchStore postage.Storer
+	if *batchstorePath != "" {
+		stateStore, err := statestore.NewStateStore(*batchstorePath, log.Noop)
+		if err != nil {
+			fmt.Printf("failed opening statestore %v\n", err)
+			return
+		}
+		defer stateStore.Close()
+
+		batchStore, err = batchstore.New(stateStore, func([]byte) error { return nil }, log.Noop)
+		if err != nil {
+			fmt.Printf("failed opening batchstore %v\n", err)
+			return
+		}
+	}
+
+	sharkyStore, err := sharky.New(sharkyBase, sharkyShardCnt, swarm.SocMaxChunkSize)
 	if err != nil {
 		fmt.Printf("failed initializing sharky %v\n")
 		return
@@ -90,7 +161,7 @@ func main() {
 	}
 
 	// Index storing actual chunk address, data and bin id.
-	headerSize := 16 + postage.StampSize
+	headerSize := retrievalDataHeaderSize
 	retrievalDataIndex, err := sh.NewIndex("Address->StoreTimestamp|BinID|BatchID|BatchIndex|Sig|Location", shed.IndexFuncs{
 		EncodeKey: func(fields shed.Item) (key []byte, err error) {
 			return fields.Address, nil
@@ -154,15 +225,25 @@ func main() {
 		fmt.Printf("failed initializing index %v\n")
 		return
 	}
+	// proximityIssues collects PO MISMATCH / BINID GAP / BINID REORDER
+	// findings surfaced while decoding pullIndex and postageChunksIndex
+	// below, only populated when -basekey is given.
+	var proximityIssues []string
+	// lastBinIDPerBin tracks the last BinID seen per PO bin so pullIndex
+	// decoding can flag non-monotonic BinIDs, a common pullsync symptom.
+	lastBinIDPerBin := make(map[uint8]uint64)
+	var lastPullPO uint8
+
 	// pull index allows history and live syncing per po bin
 	pullIndex, err := sh.NewIndex("PO|BinID->Hash", shed.IndexFuncs{
 		EncodeKey: func(fields shed.Item) (key []byte, err error) {
 			key = make([]byte, 9)
-			// key[0] = db.po(swarm.NewAddress(fields.Address))
+			key[0] = po(baseKey, fields.Address)
 			binary.BigEndian.PutUint64(key[1:9], fields.BinID)
 			return key, nil
 		},
 		DecodeKey: func(key []byte) (e shed.Item, err error) {
+			lastPullPO = key[0]
 			e.BinID = binary.BigEndian.Uint64(key[1:9])
 			return e, nil
 		},
@@ -175,6 +256,23 @@ func main() {
 		DecodeValue: func(keyItem shed.Item, value []byte) (e shed.Item, err error) {
 			e.Address = value[:32]
 			e.BatchID = value[32:64]
+
+			if len(baseKey) > 0 {
+				addrStr := swarm.NewAddress(e.Address).String()
+				if expected := po(baseKey, e.Address); expected != lastPullPO {
+					proximityIssues = append(proximityIssues, fmt.Sprintf("PO MISMATCH: addr=%s expected=%d got=%d", addrStr, expected, lastPullPO))
+				}
+				if last, ok := lastBinIDPerBin[lastPullPO]; ok {
+					switch {
+					case keyItem.BinID <= last:
+						proximityIssues = append(proximityIssues, fmt.Sprintf("BINID REORDER: po=%d binID=%d last=%d", lastPullPO, keyItem.BinID, last))
+					case keyItem.BinID != last+1:
+						proximityIssues = append(proximityIssues, fmt.Sprintf("BINID GAP: po=%d from=%d to=%d", lastPullPO, last, keyItem.BinID))
+					}
+				}
+				lastBinIDPerBin[lastPullPO] = keyItem.BinID
+			}
+
 			return e, nil
 		},
 	})
@@ -273,13 +371,18 @@ func main() {
 		EncodeKey: func(fields shed.Item) (key []byte, err error) {
 			key = make([]byte, 65)
 			copy(key[:32], fields.BatchID)
-			// key[32] = db.po(swarm.NewAddress(fields.Address))
+			key[32] = po(baseKey, fields.Address)
 			copy(key[33:], fields.Address)
 			return key, nil
 		},
 		DecodeKey: func(key []byte) (e shed.Item, err error) {
 			e.BatchID = key[:32]
 			e.Address = key[33:65]
+			if len(baseKey) > 0 {
+				if expected := po(baseKey, e.Address); expected != key[32] {
+					proximityIssues = append(proximityIssues, fmt.Sprintf("PO MISMATCH: addr=%s expected=%d got=%d", swarm.NewAddress(e.Address).String(), expected, key[32]))
+				}
+			}
 			return e, nil
 		},
 		EncodeValue: func(fields shed.Item) (value []byte, err error) {
@@ -325,7 +428,7 @@ func main() {
 
 	fmt.Printf("Starting check for localstore at %s...\n", *path)
 
-	var inconsistencies, corruptions []string
+	var inconsistencies, corruptions, stampIssues []string
 
 	inconsistencies = append(inconsistencies, checkIndexes(retrievalAccessIndex, retrievalDataIndex, "retrievalAccessIdx", "retrievalDataIndex")...)
 	inconsistencies = append(inconsistencies, checkIndexes(pullIndex, retrievalDataIndex, "pullIdx", "retrievalDataIndex")...)
@@ -335,13 +438,41 @@ func main() {
 	inconsistencies = append(inconsistencies, checkIndexes(postageChunksIndex, retrievalDataIndex, "postageChunksIdx", "retrievalDataIndex")...)
 	inconsistencies = append(inconsistencies, checkIndexes(postageIndexIndex, retrievalDataIndex, "postageIndexIdx", "retrievalDataIndex")...)
 
-	gcCnt, _ := gcSize.Get()
-	rsvCnt, _ := reserveSize.Get()
+	// checkStamp and reconcileReserveGC both need reserve/gc membership per
+	// chunk, but postageChunksIndex's key embeds a PO byte and gcIndex's
+	// embeds AccessTimestamp, neither of which retrievalDataIndex items
+	// carry, so Has(item) can't be used (see reconcileReserveGC's doc
+	// comment). Build both address sets once by forward iteration and share
+	// them, rather than having every consumer re-scan the same index.
+	reserveAddrs, err := reserveBatchAddressSet(postageChunksIndex)
+	if err != nil {
+		fmt.Printf("failed building reserve address set %v\n", err)
+		return
+	}
+	gcAddrs, err := indexAddressSet(gcIndex)
+	if err != nil {
+		fmt.Printf("failed building gc address set %v\n", err)
+		return
+	}
 
-	chunkCnt, _ := retrievalDataIndex.Count()
+	// Repair for reserve/gc misclassification runs later, after the derived
+	// indexes have been rebuilt, so this first pass is report-only.
+	reserveGCMsgs, err := reconcileReserveGC(sh, retrievalDataIndex, retrievalAccessIndex, gcIndex, pinIndex, reserveAddrs, gcAddrs, gcSize, reserveSize, false)
+	if err != nil {
+		fmt.Printf("failed reconciling reserve/gc %v\n", err)
+		return
+	}
 
-	if int(gcCnt+rsvCnt) > chunkCnt {
-		inconsistencies = append(inconsistencies, fmt.Sprintf("gcSize+reserveSize(%d) > chunkCount(%d)", gcCnt+rsvCnt, chunkCnt))
+	var tw *tar.Writer
+	if *exportPath != "" {
+		f, err := os.Create(*exportPath)
+		if err != nil {
+			fmt.Printf("failed creating export archive %v\n", err)
+			return
+		}
+		defer f.Close()
+		tw = tar.NewWriter(f)
+		defer tw.Close()
 	}
 
 	err = retrievalDataIndex.Iterate(func(item shed.Item) (bool, error) {
@@ -357,11 +488,24 @@ func main() {
 			return false, nil
 		}
 		ch := swarm.NewChunk(swarm.NewAddress(item.Address), data)
-		if !cac.Valid(ch) && !soc.Valid(ch) {
+		valid := cac.Valid(ch) || soc.Valid(ch)
+		if !valid {
 			corruptions = append(corruptions, fmt.Sprintf("address %s", ch.Address().String()))
 		}
+		stampIssues = append(stampIssues, checkStamp(item, ch, batchStore, postageIndexIndex, reserveAddrs)...)
+
+		if tw != nil && valid {
+			if err := exportChunk(tw, item, ch); err != nil {
+				fmt.Fprintf(os.Stderr, "export: skipping %s: %v\n", ch.Address().String(), err)
+			}
+		}
+
 		return false, nil
 	}, nil)
+	if err != nil {
+		fmt.Printf("failed iterating retrievalDataIndex %v\n", err)
+		return
+	}
 
 	fmt.Printf("Check complete")
 	if len(inconsistencies) > 0 {
@@ -376,10 +520,215 @@ func main() {
 			fmt.Printf("DATA CORRUPTION: %s\n", v)
 		}
 	}
+	fmt.Println("Note: sharky has no read-only way to list used-but-unreferenced storage; run with -repair to find and reclaim sharky leaks")
+	if len(stampIssues) > 0 {
+		fmt.Printf("Found %d invalid postage stamps\n", len(stampIssues))
+		for _, v := range stampIssues {
+			fmt.Printf("STAMP INVALID: %s\n", v)
+		}
+	}
+	if len(proximityIssues) > 0 {
+		fmt.Printf("Found %d proximity/BinID issues\n", len(proximityIssues))
+		for _, v := range proximityIssues {
+			fmt.Printf("%s\n", v)
+		}
+	}
+	fmt.Println("Reserve/GC reconciliation:")
+	for _, v := range reserveGCMsgs {
+		fmt.Printf("%s\n", v)
+	}
 
-	if len(corruptions) == 0 && len(inconsistencies) == 0 {
+	if len(corruptions) == 0 && len(inconsistencies) == 0 && len(stampIssues) == 0 && len(proximityIssues) == 0 && len(reserveGCMsgs) == 1 {
 		fmt.Println("No inconsistencies or corruptions found")
 	}
+
+	if *repair {
+		fmt.Println("Starting repair...")
+		// sharkyStore must be closed before sharky.Recovery opens the same
+		// shard files below; sharky doesn't support two open handles onto
+		// one base directory.
+		if err := sharkyStore.Close(); err != nil {
+			fmt.Printf("repair failed: closing sharky: %v\n", err)
+			return
+		}
+		if err := checkSharkyLeaks(sharkyBasePath, sharkyShardCnt, swarm.SocMaxChunkSize, retrievalDataIndex); err != nil {
+			fmt.Printf("repair failed: reclaiming sharky leaks: %v\n", err)
+			return
+		}
+		if err := runRepair(sh, retrievalDataIndex, retrievalAccessIndex, pullIndex, pushIndex, gcIndex, postageChunksIndex, postageIndexIndex); err != nil {
+			fmt.Printf("repair failed: %v\n", err)
+			return
+		}
+		// Rebuild reserveAddrs/gcAddrs rather than reusing the pre-repair
+		// sets: runRepair just rewrote postageChunksIndex and gcIndex.
+		postRepairReserveAddrs, err := reserveBatchAddressSet(postageChunksIndex)
+		if err != nil {
+			fmt.Printf("repair failed: rebuilding reserve address set: %v\n", err)
+			return
+		}
+		postRepairGCAddrs, err := indexAddressSet(gcIndex)
+		if err != nil {
+			fmt.Printf("repair failed: rebuilding gc address set: %v\n", err)
+			return
+		}
+		if _, err := reconcileReserveGC(sh, retrievalDataIndex, retrievalAccessIndex, gcIndex, pinIndex, postRepairReserveAddrs, postRepairGCAddrs, gcSize, reserveSize, true); err != nil {
+			fmt.Printf("repair failed: reconciling reserve/gc: %v\n", err)
+			return
+		}
+		fmt.Println("Repair complete")
+	}
+}
+
+// runRepair treats retrievalDataIndex (and sharky, as the chunk data behind
+// it) as the source of truth: orphan entries whose retrievalDataIndex entry
+// is missing are deleted from every derived index, and entries missing from
+// pullIndex/postageChunksIndex/postageIndexIndex - which are legitimately
+// 1:1 with retrievalDataIndex - are reconstructed from the fields stored on
+// the retrievalDataIndex item. pushIndex and gcIndex are deliberately left
+// out of that reconstruction: a missing pushIndex entry just means the
+// chunk already synced (pushIndex tracks "as yet unsynced chunks", not
+// every chunk), and gc/reserve membership isn't derivable from
+// retrievalDataIndex alone - reconcileReserveGC, called after runRepair,
+// is the index-aware pass that adds a chunk to gcIndex only if it doesn't
+// already belong to the reserve or a pin. It does not touch gc-size or
+// reserve-size either; reconcileReserveGC recomputes those once
+// classification is correct.
+func runRepair(
+	sh *shed.DB,
+	retrievalDataIndex, retrievalAccessIndex, pullIndex, pushIndex, gcIndex, postageChunksIndex, postageIndexIndex shed.Index,
+) error {
+	derived := []struct {
+		idx  shed.Index
+		name string
+	}{
+		{pullIndex, "pullIndex"},
+		{pushIndex, "pushIndex"},
+		{gcIndex, "gcIndex"},
+		{postageChunksIndex, "postageChunksIndex"},
+		{postageIndexIndex, "postageIndexIndex"},
+	}
+
+	for _, d := range derived {
+		removed, err := removeOrphans(sh, d.idx, retrievalDataIndex, d.name)
+		if err != nil {
+			return fmt.Errorf("removing orphans from %s: %w", d.name, err)
+		}
+		if removed > 0 {
+			fmt.Printf("REPAIR: removed %d orphan entries from %s\n", removed, d.name)
+		}
+	}
+
+	// pushIndex and gcIndex are intentionally absent here: neither is 1:1
+	// with retrievalDataIndex (see the doc comment above), so blanket
+	// "missing ⇒ rebuild" would wrongly re-queue every already-synced
+	// chunk for push and gc-candidate every reserved/pinned chunk.
+	rebuilders := []struct {
+		idx   shed.Index
+		name  string
+		build func(shed.Item) shed.Item
+	}{
+		{pullIndex, "pullIndex", func(item shed.Item) shed.Item {
+			return shed.Item{Address: item.Address, BinID: item.BinID, BatchID: item.BatchID}
+		}},
+		{postageChunksIndex, "postageChunksIndex", func(item shed.Item) shed.Item {
+			return shed.Item{Address: item.Address, BatchID: item.BatchID}
+		}},
+		{postageIndexIndex, "postageIndexIndex", func(item shed.Item) shed.Item {
+			return shed.Item{Address: item.Address, BatchID: item.BatchID, Index: item.Index, Timestamp: item.Timestamp}
+		}},
+	}
+
+	for _, r := range rebuilders {
+		added, err := rebuildMissing(sh, retrievalDataIndex, r.idx, r.name, r.build)
+		if err != nil {
+			return fmt.Errorf("rebuilding %s: %w", r.name, err)
+		}
+		if added > 0 {
+			fmt.Printf("REPAIR: reconstructed %d missing entries in %s\n", added, r.name)
+		}
+	}
+
+	// gc-size and reserve-size are left for reconcileReserveGC to set, since
+	// it classifies chunks correctly instead of assuming every non-gc chunk
+	// belongs to the reserve.
+
+	return nil
+}
+
+// removeOrphans deletes every entry of derivedIdx whose key has no matching
+// entry in retrievalDataIndex, flushing a leveldb.Batch every
+// repairBatchSize items so a crash mid-repair leaves the DB consistent.
+func removeOrphans(sh *shed.DB, derivedIdx, retrievalDataIndex shed.Index, name string) (removed int, err error) {
+	batch := new(leveldb.Batch)
+	pending := 0
+
+	err = derivedIdx.Iterate(func(item shed.Item) (bool, error) {
+		exists, err := retrievalDataIndex.Has(item)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return false, nil
+		}
+		if err := derivedIdx.DeleteInBatch(batch, item); err != nil {
+			return false, err
+		}
+		removed++
+		pending++
+		if pending >= repairBatchSize {
+			if err := sh.WriteBatch(batch); err != nil {
+				return false, err
+			}
+			batch = new(leveldb.Batch)
+			pending = 0
+		}
+		return false, nil
+	}, nil)
+	if err != nil {
+		return removed, err
+	}
+	if pending > 0 {
+		return removed, sh.WriteBatch(batch)
+	}
+	return removed, nil
+}
+
+// rebuildMissing walks retrievalDataIndex and reconstructs, via build, any
+// entry missing from derivedIdx, flushing a leveldb.Batch every
+// repairBatchSize items so a crash mid-repair leaves the DB consistent.
+func rebuildMissing(sh *shed.DB, retrievalDataIndex, derivedIdx shed.Index, name string, build func(shed.Item) shed.Item) (added int, err error) {
+	batch := new(leveldb.Batch)
+	pending := 0
+
+	err = retrievalDataIndex.Iterate(func(item shed.Item) (bool, error) {
+		exists, err := derivedIdx.Has(item)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return false, nil
+		}
+		if err := derivedIdx.PutInBatch(batch, build(item)); err != nil {
+			return false, err
+		}
+		added++
+		pending++
+		if pending >= repairBatchSize {
+			if err := sh.WriteBatch(batch); err != nil {
+				return false, err
+			}
+			batch = new(leveldb.Batch)
+			pending = 0
+		}
+		return false, nil
+	}, nil)
+	if err != nil {
+		return added, err
+	}
+	if pending > 0 {
+		return added, sh.WriteBatch(batch)
+	}
+	return added, nil
 }
 
 func checkIndexes(
@@ -401,3 +750,679 @@ func checkIndexes(
 
 	return msgs
 }
+
+// indexAddressSet iterates idx and collects every item's Address. It exists
+// because shed.Index.Has re-encodes its key from the fields the caller
+// passes in, so it can only answer "is this key present" when the caller
+// already has every field the index's EncodeKey needs (e.g. gcIndex's key
+// embeds AccessTimestamp, postageChunksIndex's embeds a PO byte); building
+// the address set by forward iteration instead sidesteps that requirement.
+func indexAddressSet(idx shed.Index) (map[string]struct{}, error) {
+	addrs := make(map[string]struct{})
+	err := idx.Iterate(func(item shed.Item) (bool, error) {
+		addrs[string(item.Address)] = struct{}{}
+		return false, nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// reserveBatchAddressSet iterates postageChunksIndex (BatchID|PO|Hash->nil)
+// and collects the set of BatchID+Address pairs it contains, for the same
+// Has()-can't-reconstruct-this-key reason indexAddressSet exists. Unlike
+// indexAddressSet, membership here keys on BatchID+Address rather than
+// Address alone: a chunk address can legitimately appear in the reserve
+// under more than one batch, and retrievalDataIndex only keeps one (the
+// current) BatchID per address, so collapsing to Address-only membership
+// would miss a chunk whose current stamp doesn't match the batch it was
+// actually reserved under.
+func reserveBatchAddressSet(postageChunksIndex shed.Index) (map[string]struct{}, error) {
+	set := make(map[string]struct{})
+	err := postageChunksIndex.Iterate(func(item shed.Item) (bool, error) {
+		set[string(item.BatchID)+string(item.Address)] = struct{}{}
+		return false, nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// checkSharkyLeaks reclaims sharky storage that retrievalDataIndex no
+// longer references: space a chunk once occupied but that nothing points
+// at any more, which sharky would otherwise never give back. sharky keeps
+// its shard free-slot bitmap private to the package - Read/Write/Release/
+// Close is the whole public Store surface, there is no SlotCount/SlotInfo
+// to walk it directly. The only exported way to tell "used" from "free" is
+// sharky.Recovery, the mechanism Bee itself uses to rebuild that bitmap
+// after a non-graceful shutdown: Add marks a location as referenced, and
+// Save rewrites each shard's free-slots file so that everything not
+// Add-ed becomes free. That means leaked space can only be found by
+// reclaiming it - there is no report-only mode - so this only runs under
+// -repair, with sharkyStore closed first (sharky doesn't support a second
+// open handle onto the same base directory).
+//
+// Recovery exposes no count of what it frees, so we can't print the exact
+// number of slots reclaimed or their shard/slot/length - reporting that
+// would mean re-introducing the same SlotCount/SlotInfo introspection that
+// doesn't exist on sharky.Store either. What we can report honestly is how
+// many locations retrievalDataIndex handed to Add, i.e. how much sharky
+// storage is still referenced after the reclaim; an operator comparing
+// that against the chunk count reported elsewhere in this run has a way
+// to sanity-check the repair.
+func checkSharkyLeaks(sharkyBasePath string, shardCnt int, maxChunkSize int, retrievalDataIndex shed.Index) error {
+	recovery, err := sharky.NewRecovery(sharkyBasePath, shardCnt, maxChunkSize)
+	if err != nil {
+		return fmt.Errorf("opening sharky recovery: %w", err)
+	}
+	defer recovery.Close()
+
+	referenced := 0
+	err = retrievalDataIndex.Iterate(func(item shed.Item) (bool, error) {
+		l, err := sharky.LocationFromBinary(item.Location)
+		if err != nil {
+			return false, nil
+		}
+		if err := recovery.Add(l); err != nil {
+			return false, fmt.Errorf("marking %+v as referenced: %w", l, err)
+		}
+		referenced++
+		return false, nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := recovery.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("REPAIR: sharky now retains only the %d locations referenced by retrievalDataIndex; anything else has been reclaimed\n", referenced)
+	return nil
+}
+
+// checkStamp reconstructs the postage stamp attached to item and verifies
+// it the same way Bee does on receipt: the signature must match the batch
+// owner (only possible when batchStore is set, i.e. -batchstore was given),
+// postageIndexIndex must map the stamp's batch+index back to this chunk, and
+// reserveAddrs (built from postageChunksIndex by reserveBatchAddressSet)
+// must list this chunk under its current BatchID. reserveAddrs keys on
+// BatchID+Address rather than Address alone because a chunk address can
+// appear in the reserve under more than one batch; it isn't looked up via
+// postageChunksIndex.Has(item) because that index's key embeds a PO byte
+// that item doesn't carry. Each failure is reported as its own "reason="
+// entry rather than bailing out on the first.
+func checkStamp(item shed.Item, ch swarm.Chunk, batchStore postage.Storer, postageIndexIndex shed.Index, reserveAddrs map[string]struct{}) (msgs []string) {
+	addr := ch.Address().String()
+	stamp := postage.NewStamp(item.BatchID, item.Index, item.Timestamp, item.Sig)
+
+	if batchStore != nil {
+		batch, err := batchStore.Get(item.BatchID)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("addr=%s reason=batch not found: %v", addr, err))
+		} else if err := stamp.Valid(ch.Address(), batch.Owner); err != nil {
+			msgs = append(msgs, fmt.Sprintf("addr=%s reason=invalid signature: %v", addr, err))
+		}
+	}
+
+	indexItem, err := postageIndexIndex.Get(shed.Item{BatchID: item.BatchID, Index: item.Index})
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("addr=%s reason=missing postageIndexIndex entry: %v", addr, err))
+	} else if !swarm.NewAddress(indexItem.Address).Equal(ch.Address()) || string(indexItem.Timestamp) != string(item.Timestamp) {
+		msgs = append(msgs, fmt.Sprintf("addr=%s reason=postageIndexIndex maps to a different chunk or timestamp", addr))
+	}
+
+	if _, exists := reserveAddrs[string(item.BatchID)+string(item.Address)]; !exists {
+		msgs = append(msgs, fmt.Sprintf("addr=%s reason=missing postageChunksIndex entry", addr))
+	}
+
+	return msgs
+}
+
+// reconcileReserveGC classifies every chunk in retrievalDataIndex as
+// reserve (a reserveAddrs member), gc (a gcAddrs member) or pinned, and
+// reports chunks that land in more than one of the mutually exclusive
+// buckets (reserve+gc, or gc+pinned) as well as chunks that land in none
+// (neither reserved nor gc'd, and unpinned - these are stuck). The final
+// message is always the Venn summary "reserve=N, gc=M, pinned=P, total=T".
+// Under doRepair, misclassified chunks are moved into gcIndex or out of it
+// as appropriate, and gc-size/reserve-size are overwritten to match.
+//
+// reserveAddrs and gcAddrs are address sets the caller builds by
+// forward-iterating postageChunksIndex (via reserveBatchAddressSet) and
+// gcIndex (via indexAddressSet) - this function takes them as parameters
+// rather than rebuilding them itself so that a caller which already has
+// them (checkStamp's pass needs the same reserve set) doesn't pay for a
+// second full index scan. They aren't derived via Has(item): gcIndex's key
+// embeds AccessTimestamp and postageChunksIndex's embeds a PO byte, neither
+// of which retrievalDataIndex carries, so Has(item) would silently
+// re-encode the wrong key and misclassify almost every chunk. pinIndex's
+// key is just Address, so Has(item) is safe there. gcIndex itself is still
+// needed (not just gcAddrs) because doRepair mutates it, and every mutation
+// looks up the real AccessTimestamp via retrievalAccessIndex.Get first -
+// gcIndex's key embeds AccessTimestamp, so a DeleteInBatch/PutInBatch built
+// from a zero-valued one (retrievalDataIndex items never carry it) would
+// silently re-encode the wrong key and no-op.
+func reconcileReserveGC(
+	sh *shed.DB,
+	retrievalDataIndex, retrievalAccessIndex, gcIndex, pinIndex shed.Index,
+	reserveAddrs, gcAddrs map[string]struct{},
+	gcSize, reserveSize shed.Uint64Field,
+	doRepair bool,
+) (msgs []string, err error) {
+	var reserveCnt, gcCnt, pinnedCnt, totalCnt int
+
+	batch := new(leveldb.Batch)
+	pending := 0
+	flush := func() error {
+		if pending == 0 {
+			return nil
+		}
+		if err := sh.WriteBatch(batch); err != nil {
+			return err
+		}
+		batch = new(leveldb.Batch)
+		pending = 0
+		return nil
+	}
+
+	err = retrievalDataIndex.Iterate(func(item shed.Item) (bool, error) {
+		totalCnt++
+
+		_, inReserve := reserveAddrs[string(item.BatchID)+string(item.Address)]
+		_, inGC := gcAddrs[string(item.Address)]
+		inPin, err := pinIndex.Has(item)
+		if err != nil {
+			return false, err
+		}
+		if inReserve {
+			reserveCnt++
+		}
+		if inGC {
+			gcCnt++
+		}
+		if inPin {
+			pinnedCnt++
+		}
+
+		addrStr := swarm.NewAddress(item.Address).String()
+		moveIntoGC := false
+		moveOutOfGC := false
+
+		switch {
+		case inReserve && inGC:
+			msgs = append(msgs, fmt.Sprintf("chunk in both reserve and gc addr=%s", addrStr))
+			moveOutOfGC = true
+		case inGC && inPin:
+			msgs = append(msgs, fmt.Sprintf("chunk in gc but pinned addr=%s", addrStr))
+			moveOutOfGC = true
+		case !inReserve && !inGC && !inPin:
+			msgs = append(msgs, fmt.Sprintf("chunk in neither reserve nor gc and unpinned addr=%s", addrStr))
+			moveIntoGC = true
+		}
+
+		if !doRepair {
+			return false, nil
+		}
+
+		accessTimestamp := item.StoreTimestamp
+		if moveOutOfGC || moveIntoGC {
+			if accessItem, err := retrievalAccessIndex.Get(item); err == nil {
+				accessTimestamp = accessItem.AccessTimestamp
+			}
+		}
+
+		if moveOutOfGC {
+			// gcIndex's key is AccessTimestamp|BinID|Hash; item's
+			// AccessTimestamp is always zero (retrievalDataIndex doesn't
+			// store it), so DeleteInBatch needs the real one looked up
+			// above or it silently re-encodes a key gcIndex never had.
+			gcItem := shed.Item{
+				Address:         item.Address,
+				BinID:           item.BinID,
+				AccessTimestamp: accessTimestamp,
+			}
+			if err := gcIndex.DeleteInBatch(batch, gcItem); err != nil {
+				return false, err
+			}
+			gcCnt--
+			pending++
+		} else if moveIntoGC {
+			gcItem := shed.Item{
+				Address:         item.Address,
+				BinID:           item.BinID,
+				BatchID:         item.BatchID,
+				Index:           item.Index,
+				AccessTimestamp: accessTimestamp,
+			}
+			if err := gcIndex.PutInBatch(batch, gcItem); err != nil {
+				return false, err
+			}
+			gcCnt++
+			pending++
+		}
+
+		if pending >= repairBatchSize {
+			return false, flush()
+		}
+		return false, nil
+	}, nil)
+	if err != nil {
+		return msgs, err
+	}
+	if err := flush(); err != nil {
+		return msgs, err
+	}
+
+	msgs = append(msgs, fmt.Sprintf("reserve=%d, gc=%d, pinned=%d, total=%d", reserveCnt, gcCnt, pinnedCnt, totalCnt))
+
+	if doRepair {
+		if err := gcSize.Put(uint64(gcCnt)); err != nil {
+			return msgs, fmt.Errorf("updating gc-size: %w", err)
+		}
+		if err := reserveSize.Put(uint64(reserveCnt)); err != nil {
+			return msgs, fmt.Errorf("updating reserve-size: %w", err)
+		}
+	}
+
+	return msgs, nil
+}
+
+// exportChunk appends one chunk to an -export tar stream in the Bee
+// localstore export layout: the header name is hex(address), and the body
+// is the chunk's marshalled postage stamp followed by its data, so -import
+// can replay it without consulting any index.
+func exportChunk(tw *tar.Writer, item shed.Item, ch swarm.Chunk) error {
+	stamp, err := postage.NewStamp(item.BatchID, item.Index, item.Timestamp, item.Sig).MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("marshalling stamp: %w", err)
+	}
+	body := append(stamp, ch.Data()...)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: hex.EncodeToString(ch.Address().Bytes()),
+		Mode: 0644,
+		Size: int64(len(body)),
+	}); err != nil {
+		return fmt.Errorf("writing tar header: %w", err)
+	}
+	_, err = tw.Write(body)
+	return err
+}
+
+// importIndexes holds the seven retrievalDataIndex-derived indexes -import
+// opens. postageChunksIndex is created but left empty by -import itself
+// (see runImport); pinIndex is deliberately absent altogether: the export
+// archive carries no record of which chunks were pinned.
+type importIndexes struct {
+	retrievalDataIndex   shed.Index
+	retrievalAccessIndex shed.Index
+	pullIndex            shed.Index
+	pushIndex            shed.Index
+	gcIndex              shed.Index
+	postageChunksIndex   shed.Index
+	postageIndexIndex    shed.Index
+}
+
+// newImportIndexes defines the same seven indexes main opens for checking,
+// minus the PO and BinID-ordering instrumentation that only makes sense
+// against an existing, already-proximity-sorted store: -import writes a
+// fresh store in archive order, so those bytes are just left zero.
+func newImportIndexes(sh *shed.DB) (*importIndexes, error) {
+	retrievalDataIndex, err := sh.NewIndex("Address->StoreTimestamp|BinID|BatchID|BatchIndex|Sig|Location", shed.IndexFuncs{
+		EncodeKey: func(fields shed.Item) (key []byte, err error) {
+			return fields.Address, nil
+		},
+		DecodeKey: func(key []byte) (e shed.Item, err error) {
+			e.Address = key
+			return e, nil
+		},
+		EncodeValue: func(fields shed.Item) (value []byte, err error) {
+			b := make([]byte, retrievalDataHeaderSize)
+			binary.BigEndian.PutUint64(b[:8], fields.BinID)
+			binary.BigEndian.PutUint64(b[8:16], uint64(fields.StoreTimestamp))
+			stamp, err := postage.NewStamp(fields.BatchID, fields.Index, fields.Timestamp, fields.Sig).MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			copy(b[16:], stamp)
+			return append(b, fields.Location...), nil
+		},
+		DecodeValue: func(keyItem shed.Item, value []byte) (e shed.Item, err error) {
+			e.BinID = binary.BigEndian.Uint64(value[:8])
+			e.StoreTimestamp = int64(binary.BigEndian.Uint64(value[8:16]))
+			stamp := new(postage.Stamp)
+			if err = stamp.UnmarshalBinary(value[16:retrievalDataHeaderSize]); err != nil {
+				return e, err
+			}
+			e.BatchID = stamp.BatchID()
+			e.Index = stamp.Index()
+			e.Timestamp = stamp.Timestamp()
+			e.Sig = stamp.Sig()
+			e.Location = value[retrievalDataHeaderSize:]
+			return e, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initializing retrievalDataIndex: %w", err)
+	}
+
+	retrievalAccessIndex, err := sh.NewIndex("Address->AccessTimestamp", shed.IndexFuncs{
+		EncodeKey: func(fields shed.Item) (key []byte, err error) {
+			return fields.Address, nil
+		},
+		DecodeKey: func(key []byte) (e shed.Item, err error) {
+			e.Address = key
+			return e, nil
+		},
+		EncodeValue: func(fields shed.Item) (value []byte, err error) {
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, uint64(fields.AccessTimestamp))
+			return b, nil
+		},
+		DecodeValue: func(keyItem shed.Item, value []byte) (e shed.Item, err error) {
+			e.AccessTimestamp = int64(binary.BigEndian.Uint64(value))
+			return e, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initializing retrievalAccessIndex: %w", err)
+	}
+
+	pullIndex, err := sh.NewIndex("PO|BinID->Hash", shed.IndexFuncs{
+		EncodeKey: func(fields shed.Item) (key []byte, err error) {
+			key = make([]byte, 9)
+			key[0] = po(nil, fields.Address)
+			binary.BigEndian.PutUint64(key[1:9], fields.BinID)
+			return key, nil
+		},
+		DecodeKey: func(key []byte) (e shed.Item, err error) {
+			e.BinID = binary.BigEndian.Uint64(key[1:9])
+			return e, nil
+		},
+		EncodeValue: func(fields shed.Item) (value []byte, err error) {
+			value = make([]byte, 64)
+			copy(value, fields.Address)
+			copy(value[32:], fields.BatchID)
+			return value, nil
+		},
+		DecodeValue: func(keyItem shed.Item, value []byte) (e shed.Item, err error) {
+			e.Address = value[:32]
+			e.BatchID = value[32:64]
+			return e, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initializing pullIndex: %w", err)
+	}
+
+	pushIndex, err := sh.NewIndex("StoreTimestamp|Hash->Tags", shed.IndexFuncs{
+		EncodeKey: func(fields shed.Item) (key []byte, err error) {
+			key = make([]byte, 40)
+			binary.BigEndian.PutUint64(key[:8], uint64(fields.StoreTimestamp))
+			copy(key[8:], fields.Address)
+			return key, nil
+		},
+		DecodeKey: func(key []byte) (e shed.Item, err error) {
+			e.Address = key[8:]
+			e.StoreTimestamp = int64(binary.BigEndian.Uint64(key[:8]))
+			return e, nil
+		},
+		EncodeValue: func(fields shed.Item) (value []byte, err error) {
+			tag := make([]byte, 4)
+			binary.BigEndian.PutUint32(tag, fields.Tag)
+			return tag, nil
+		},
+		DecodeValue: func(keyItem shed.Item, value []byte) (e shed.Item, err error) {
+			if len(value) == 4 {
+				e.Tag = binary.BigEndian.Uint32(value)
+			}
+			return e, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initializing pushIndex: %w", err)
+	}
+
+	gcIndex, err := sh.NewIndex("AccessTimestamp|BinID|Hash->BatchID|BatchIndex", shed.IndexFuncs{
+		EncodeKey: func(fields shed.Item) (key []byte, err error) {
+			b := make([]byte, 16, 16+len(fields.Address))
+			binary.BigEndian.PutUint64(b[:8], uint64(fields.AccessTimestamp))
+			binary.BigEndian.PutUint64(b[8:16], fields.BinID)
+			return append(b, fields.Address...), nil
+		},
+		DecodeKey: func(key []byte) (e shed.Item, err error) {
+			e.AccessTimestamp = int64(binary.BigEndian.Uint64(key[:8]))
+			e.BinID = binary.BigEndian.Uint64(key[8:16])
+			e.Address = key[16:]
+			return e, nil
+		},
+		EncodeValue: func(fields shed.Item) (value []byte, err error) {
+			value = make([]byte, 40)
+			copy(value, fields.BatchID)
+			copy(value[32:], fields.Index)
+			return value, nil
+		},
+		DecodeValue: func(keyItem shed.Item, value []byte) (e shed.Item, err error) {
+			e.BatchID = make([]byte, 32)
+			copy(e.BatchID, value[:32])
+			e.Index = make([]byte, postage.IndexSize)
+			copy(e.Index, value[32:])
+			return e, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initializing gcIndex: %w", err)
+	}
+
+	postageChunksIndex, err := sh.NewIndex("BatchID|PO|Hash->nil", shed.IndexFuncs{
+		EncodeKey: func(fields shed.Item) (key []byte, err error) {
+			key = make([]byte, 65)
+			copy(key[:32], fields.BatchID)
+			key[32] = po(nil, fields.Address)
+			copy(key[33:], fields.Address)
+			return key, nil
+		},
+		DecodeKey: func(key []byte) (e shed.Item, err error) {
+			e.BatchID = key[:32]
+			e.Address = key[33:65]
+			return e, nil
+		},
+		EncodeValue: func(fields shed.Item) (value []byte, err error) {
+			return nil, nil
+		},
+		DecodeValue: func(keyItem shed.Item, value []byte) (e shed.Item, err error) {
+			return e, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initializing postageChunksIndex: %w", err)
+	}
+
+	postageIndexIndex, err := sh.NewIndex("BatchID|BatchIndex->Hash|Timestamp", shed.IndexFuncs{
+		EncodeKey: func(fields shed.Item) (key []byte, err error) {
+			key = make([]byte, 40)
+			copy(key[:32], fields.BatchID)
+			copy(key[32:40], fields.Index)
+			return key, nil
+		},
+		DecodeKey: func(key []byte) (e shed.Item, err error) {
+			e.BatchID = key[:32]
+			e.Index = key[32:40]
+			return e, nil
+		},
+		EncodeValue: func(fields shed.Item) (value []byte, err error) {
+			value = make([]byte, 40)
+			copy(value, fields.Address)
+			copy(value[32:], fields.Timestamp)
+			return value, nil
+		},
+		DecodeValue: func(keyItem shed.Item, value []byte) (e shed.Item, err error) {
+			e.Address = value[:32]
+			e.Timestamp = value[32:]
+			return e, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initializing postageIndexIndex: %w", err)
+	}
+
+	return &importIndexes{
+		retrievalDataIndex:   retrievalDataIndex,
+		retrievalAccessIndex: retrievalAccessIndex,
+		pullIndex:            pullIndex,
+		pushIndex:            pushIndex,
+		gcIndex:              gcIndex,
+		postageChunksIndex:   postageChunksIndex,
+		postageIndexIndex:    postageIndexIndex,
+	}, nil
+}
+
+// runImport replays a tar archive written by -export into a fresh shed and
+// sharky store at basePath: every entry gets a newly allocated sharky
+// location and, since nothing in the archive says whether a chunk was
+// reserved or pinned, every chunk starts out as a gc candidate - a
+// subsequent -repair run with a populated postageChunksIndex (once the node
+// re-syncs) reclassifies it via reconcileReserveGC.
+func runImport(basePath, archivePath string) (err error) {
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return fmt.Errorf("creating %s: %w", basePath, err)
+	}
+
+	sh, err := shed.NewDB(basePath, nil)
+	if err != nil {
+		return fmt.Errorf("initializing shed: %w", err)
+	}
+	defer sh.Close()
+
+	schemaName, err := sh.NewStringField("schema-name")
+	if err != nil {
+		return fmt.Errorf("initializing schema-name field: %w", err)
+	}
+	if err := schemaName.Put(localstore.DBSchemaCurrent); err != nil {
+		return fmt.Errorf("writing schema-name: %w", err)
+	}
+
+	gcSize, err := sh.NewUint64Field("gc-size")
+	if err != nil {
+		return fmt.Errorf("initializing gc-size field: %w", err)
+	}
+	reserveSize, err := sh.NewUint64Field("reserve-size")
+	if err != nil {
+		return fmt.Errorf("initializing reserve-size field: %w", err)
+	}
+
+	sharkyBasePath := filepath.Join(basePath, "sharky")
+	if err := os.MkdirAll(sharkyBasePath, 0755); err != nil {
+		return fmt.Errorf("creating %s: %w", sharkyBasePath, err)
+	}
+	sharkyStore, err := sharky.New(&dirFS{basedir: sharkyBasePath}, sharkyShardCnt, swarm.SocMaxChunkSize)
+	if err != nil {
+		return fmt.Errorf("initializing sharky: %w", err)
+	}
+	defer sharkyStore.Close()
+
+	idx, err := newImportIndexes(sh)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("opening archive: %w", err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	var binID uint64
+	imported := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading archive: %w", err)
+		}
+
+		addr, err := hex.DecodeString(hdr.Name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import: skipping entry %q: invalid address: %v\n", hdr.Name, err)
+			continue
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import: skipping %s: %v\n", hdr.Name, err)
+			continue
+		}
+		if len(body) < postage.StampSize {
+			fmt.Fprintf(os.Stderr, "import: skipping %s: truncated stamp\n", hdr.Name)
+			continue
+		}
+
+		stamp := new(postage.Stamp)
+		if err := stamp.UnmarshalBinary(body[:postage.StampSize]); err != nil {
+			fmt.Fprintf(os.Stderr, "import: skipping %s: invalid stamp: %v\n", hdr.Name, err)
+			continue
+		}
+		data := body[postage.StampSize:]
+
+		loc, err := sharkyStore.Write(context.Background(), data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import: skipping %s: sharky write: %v\n", hdr.Name, err)
+			continue
+		}
+		location, err := loc.MarshalBinary()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import: skipping %s: %v\n", hdr.Name, err)
+			continue
+		}
+
+		now := time.Now().UnixNano()
+		item := shed.Item{
+			Address:         addr,
+			BinID:           binID,
+			BatchID:         stamp.BatchID(),
+			Index:           stamp.Index(),
+			Timestamp:       stamp.Timestamp(),
+			Sig:             stamp.Sig(),
+			Location:        location,
+			StoreTimestamp:  now,
+			AccessTimestamp: now,
+		}
+
+		if err := idx.retrievalDataIndex.Put(item); err != nil {
+			return fmt.Errorf("writing retrievalDataIndex for %s: %w", hdr.Name, err)
+		}
+		if err := idx.retrievalAccessIndex.Put(item); err != nil {
+			return fmt.Errorf("writing retrievalAccessIndex for %s: %w", hdr.Name, err)
+		}
+		if err := idx.pullIndex.Put(item); err != nil {
+			return fmt.Errorf("writing pullIndex for %s: %w", hdr.Name, err)
+		}
+		if err := idx.pushIndex.Put(item); err != nil {
+			return fmt.Errorf("writing pushIndex for %s: %w", hdr.Name, err)
+		}
+		if err := idx.gcIndex.Put(item); err != nil {
+			return fmt.Errorf("writing gcIndex for %s: %w", hdr.Name, err)
+		}
+		if err := idx.postageIndexIndex.Put(item); err != nil {
+			return fmt.Errorf("writing postageIndexIndex for %s: %w", hdr.Name, err)
+		}
+
+		binID++
+		imported++
+	}
+
+	if err := gcSize.Put(uint64(imported)); err != nil {
+		return fmt.Errorf("writing gc-size: %w", err)
+	}
+	if err := reserveSize.Put(0); err != nil {
+		return fmt.Errorf("writing reserve-size: %w", err)
+	}
+
+	fmt.Printf("imported %d chunks\n", imported)
+	return nil
+}